@@ -25,6 +25,8 @@
 package cassette
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,25 +35,82 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Cassette format versions
 const (
 	cassetteFormatV1 = 1
+	cassetteFormatV2 = 2
+)
+
+// Body encodings recorded alongside a Request or Response body so
+// that Load knows how to turn the on-disk bytes back into the
+// original payload.
+const (
+	// BodyEncodingUTF8 marks a body that is plain, human-readable
+	// text and can be used as-is.
+	BodyEncodingUTF8 = "utf8"
+
+	// BodyEncodingBase64 marks a body that is arbitrary binary data.
+	// The bytes are already in their final form once the surrounding
+	// JSON has been decoded; base64 is only an artifact of how
+	// encoding/json represents a []byte.
+	BodyEncodingBase64 = "base64"
+
+	// BodyEncodingGzipBase64 marks a body that was gzip-compressed
+	// before being stored. Callers should use DecodedBody to get the
+	// original payload back.
+	BodyEncodingGzipBase64 = "gzip+base64"
 )
 
 var (
 	// ErrInteractionNotFound indicates that a requested
 	// interaction was not found in the cassette file
 	ErrInteractionNotFound = errors.New("Requested interaction not found")
+
+	// ErrUnsupportedFormatVersion indicates that a cassette format
+	// version is not recognized
+	ErrUnsupportedFormatVersion = errors.New("Unsupported cassette format version")
+
+	// ErrUnusedInteraction indicates that Save was called on a
+	// Strict cassette while at least one recorded interaction was
+	// never matched by GetInteraction
+	ErrUnusedInteraction = errors.New("Cassette has unused interactions")
+)
+
+// MatchMode controls how GetInteraction picks among the recorded
+// interactions that match a given request.
+type MatchMode int
+
+const (
+	// MatchModeAny always returns the first matching interaction,
+	// no matter how many times it has already been returned. This
+	// is the default.
+	MatchModeAny MatchMode = iota
+
+	// MatchModeSequential returns the first matching interaction
+	// that has not yet been consumed, and marks it consumed, so
+	// repeated requests to the same URL step through the recorded
+	// responses in order instead of always getting the first one.
+	MatchModeSequential
 )
 
 // Request represents a client request as recorded in the
 // cassette file
 type Request struct {
 	// Body of request
-	Body string `json:"body"`
+	Body []byte `json:"body"`
+
+	// BodyEncoding describes how Body should be interpreted once
+	// decoded from JSON; see the BodyEncoding* constants
+	BodyEncoding string `json:"body_encoding,omitempty"`
+
+	// ContentLength is the value of the request's Content-Length
+	// header, as reported by the client
+	ContentLength int64 `json:"content_length,omitempty"`
 
 	// Form values
 	Form url.Values `json:"form"`
@@ -66,20 +125,79 @@ type Request struct {
 	Method string `json:"method"`
 }
 
+// DecodedBody returns the request body in its original form,
+// decompressing it first if BodyEncoding is BodyEncodingGzipBase64
+func (r *Request) DecodedBody() ([]byte, error) {
+	return decodeBody(r.Body, r.BodyEncoding)
+}
+
 // Response represents a server response as recorded in the
 // cassette file
 type Response struct {
 	// Body of response
-	Body string `json:"body"`
+	Body []byte `json:"body"`
+
+	// BodyEncoding describes how Body should be interpreted once
+	// decoded from JSON; see the BodyEncoding* constants
+	BodyEncoding string `json:"body_encoding,omitempty"`
 
 	// Response headers
 	Headers http.Header `json:"headers"`
 
+	// Trailers holds the response trailers, if any were sent
+	Trailers http.Header `json:"trailers,omitempty"`
+
+	// Proto is the response's HTTP protocol version, e.g. "HTTP/1.1"
+	Proto string `json:"proto,omitempty"`
+
 	// Response status message
 	Status string `json:"status"`
 
 	// Response status code
 	Code int `json:"code"`
+
+	// Duration is how long the original request took to complete
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// DecodedBody returns the response body in its original form,
+// decompressing it first if BodyEncoding is BodyEncodingGzipBase64
+func (r *Response) DecodedBody() ([]byte, error) {
+	return decodeBody(r.Body, r.BodyEncoding)
+}
+
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	if encoding != BodyEncodingGzipBase64 {
+		return body, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+// encodeBody is the inverse of decodeBody: it puts a plain body back
+// into the form BodyEncoding expects, gzip-compressing it when
+// encoding is BodyEncodingGzipBase64 and leaving it alone otherwise.
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	if encoding != BodyEncodingGzipBase64 {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 // Interaction type contains a pair of request/response for a
@@ -87,6 +205,61 @@ type Response struct {
 type Interaction struct {
 	Request  `json:"request"`
 	Response `json:"response"`
+
+	// Count is how many times this interaction has been returned by
+	// GetInteraction, so a fixture's usage can be inspected once a
+	// test has run. It is always written, including zero, so an
+	// unused fixture is visible in the saved file rather than
+	// silently omitted.
+	Count int `json:"count"`
+
+	// consumed marks the interaction as already returned once by
+	// GetInteraction under MatchModeSequential. It is reset by
+	// Rewind and is never persisted to disk.
+	consumed bool
+}
+
+// cloneInteraction returns a deep copy of i. Headers, Trailers, Form
+// and Body all wrap reference types that would otherwise alias the
+// stored interaction's data, so a BeforeSaveFilter or
+// BeforeReplayFilter run against the clone can rewrite them without
+// mutating the fixture held in c.Interactions.
+func cloneInteraction(i *Interaction) *Interaction {
+	clone := *i
+	clone.Request.Headers = cloneHeader(i.Request.Headers)
+	clone.Request.Form = url.Values(cloneHeader(http.Header(i.Request.Form)))
+	clone.Request.Body = cloneBytes(i.Request.Body)
+	clone.Response.Headers = cloneHeader(i.Response.Headers)
+	clone.Response.Trailers = cloneHeader(i.Response.Trailers)
+	clone.Response.Body = cloneBytes(i.Response.Body)
+	return &clone
+}
+
+// cloneHeader returns a deep copy of h, so appending to or
+// overwriting a value slice in the clone never touches h.
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		vc := make([]string, len(v))
+		copy(vc, v)
+		clone[k] = vc
+	}
+	return clone
+}
+
+// cloneBytes returns a copy of b backed by its own array.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	clone := make([]byte, len(b))
+	copy(clone, b)
+	return clone
 }
 
 // Matcher function returns true when the actual request matches
@@ -117,6 +290,51 @@ type Cassette struct {
 
 	// Matches actual request with interaction requests.
 	Matcher Matcher `json:"-"`
+
+	// BeforeSaveFilters run, in order, against a copy of every
+	// interaction immediately before Save persists it, so secrets
+	// can be redacted from recorded fixtures.
+	BeforeSaveFilters []Filter `json:"-"`
+
+	// BeforeReplayFilters run, in order, against a copy of the
+	// matched interaction immediately before GetInteraction returns
+	// it, so replayed responses can be rewritten at test time.
+	BeforeReplayFilters []Filter `json:"-"`
+
+	// MatchMode controls how GetInteraction picks among multiple
+	// interactions matching the same request. Defaults to
+	// MatchModeAny.
+	MatchMode MatchMode `json:"-"`
+
+	// Strict makes Save fail with ErrUnusedInteraction if any
+	// recorded interaction was never matched by GetInteraction.
+	Strict bool `json:"-"`
+
+	// watch holds the file-watch state started by LoadWithWatch.
+	// It is nil on a cassette loaded with plain Load.
+	watch *watch
+}
+
+// Filter inspects or rewrites an Interaction. Returning a non-nil
+// error aborts the Save or GetInteraction call in progress.
+type Filter func(*Interaction) error
+
+// AddFilter appends f to the cassette's BeforeSaveFilters and
+// returns the cassette so calls can be chained.
+func (c *Cassette) AddFilter(f Filter) *Cassette {
+	c.Lock()
+	c.BeforeSaveFilters = append(c.BeforeSaveFilters, f)
+	c.Unlock()
+	return c
+}
+
+// AddReplayFilter appends f to the cassette's BeforeReplayFilters
+// and returns the cassette so calls can be chained.
+func (c *Cassette) AddReplayFilter(f Filter) *Cassette {
+	c.Lock()
+	c.BeforeReplayFilters = append(c.BeforeReplayFilters, f)
+	c.Unlock()
+	return c
 }
 
 // New creates a new empty cassette
@@ -124,7 +342,7 @@ func New(name string) *Cassette {
 	c := &Cassette{
 		Name:         name,
 		File:         fmt.Sprintf("%s.json", name),
-		Version:      cassetteFormatV1,
+		Version:      cassetteFormatV2,
 		Interactions: make([]*Interaction, 0),
 		Matcher:      DefaultMatcher,
 	}
@@ -132,17 +350,104 @@ func New(name string) *Cassette {
 	return c
 }
 
-// Load reads a cassette file from disk
-func Load(name string) (*Cassette, error) {
-	c := New(name)
-	data, err := ioutil.ReadFile(c.File)
-	if err != nil {
-		return nil, err
+// SetFormatVersion sets the cassette format version that will be
+// used the next time the cassette is saved. Only cassetteFormatV1
+// and cassetteFormatV2 are recognized.
+func (c *Cassette) SetFormatVersion(version int) error {
+	switch version {
+	case cassetteFormatV1, cassetteFormatV2:
+		c.Lock()
+		c.Version = version
+		c.Unlock()
+		return nil
+	default:
+		return ErrUnsupportedFormatVersion
 	}
+}
 
-	err = json.Unmarshal(data, &c)
+// cassetteV1Request and cassetteV1Response mirror the on-disk shape
+// of a format v1 cassette, whose bodies were stored as plain strings
+type cassetteV1Request struct {
+	Body    string      `json:"body"`
+	Form    url.Values  `json:"form"`
+	Headers http.Header `json:"headers"`
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+}
+
+type cassetteV1Response struct {
+	Body    string      `json:"body"`
+	Headers http.Header `json:"headers"`
+	Status  string      `json:"status"`
+	Code    int         `json:"code"`
+}
 
-	return c, err
+type cassetteV1Interaction struct {
+	Request  cassetteV1Request  `json:"request"`
+	Response cassetteV1Response `json:"response"`
+}
+
+// cassetteV1 mirrors the on-disk shape of a format v1 cassette
+type cassetteV1 struct {
+	Version      int                      `json:"version"`
+	Interactions []*cassetteV1Interaction `json:"interactions"`
+}
+
+// upgrade converts a v1 cassette into the current in-memory
+// representation, so callers never have to special-case old
+// fixtures
+func (v1 *cassetteV1) upgrade(c *Cassette) {
+	c.Version = cassetteFormatV2
+	c.Interactions = make([]*Interaction, len(v1.Interactions))
+	for idx, i := range v1.Interactions {
+		c.Interactions[idx] = &Interaction{
+			Request: Request{
+				Body:         []byte(i.Request.Body),
+				BodyEncoding: BodyEncodingUTF8,
+				Form:         i.Request.Form,
+				Headers:      i.Request.Headers,
+				URL:          i.Request.URL,
+				Method:       i.Request.Method,
+			},
+			Response: Response{
+				Body:         []byte(i.Response.Body),
+				BodyEncoding: BodyEncodingUTF8,
+				Headers:      i.Response.Headers,
+				Status:       i.Response.Status,
+				Code:         i.Response.Code,
+			},
+		}
+	}
+}
+
+// downgrade converts the cassette's current interactions into the
+// legacy v1 on-disk shape, used when Save is asked to write a
+// format v1 cassette
+func (c *Cassette) downgrade() *cassetteV1 {
+	v1 := &cassetteV1{
+		Version:      cassetteFormatV1,
+		Interactions: make([]*cassetteV1Interaction, len(c.Interactions)),
+	}
+
+	for idx, i := range c.Interactions {
+		v1.Interactions[idx] = &cassetteV1Interaction{
+			Request: cassetteV1Request{
+				Body:    string(i.Request.Body),
+				Form:    i.Request.Form,
+				Headers: i.Request.Headers,
+				URL:     i.Request.URL,
+				Method:  i.Request.Method,
+			},
+			Response: cassetteV1Response{
+				Body:    string(i.Response.Body),
+				Headers: i.Response.Headers,
+				Status:  i.Response.Status,
+				Code:    i.Response.Code,
+			},
+		}
+	}
+
+	return v1
 }
 
 // AddInteraction appends a new interaction to the cassette
@@ -152,20 +457,151 @@ func (c *Cassette) AddInteraction(i *Interaction) {
 	c.Unlock()
 }
 
-// GetInteraction retrieves a recorded request/response interaction
+// GetInteraction retrieves a recorded request/response interaction.
+// Under MatchModeSequential, interactions already returned once are
+// skipped in favor of the next unconsumed match, so polling tests
+// can step through a sequence of recorded responses for the same
+// request. The returned interaction is a deep copy that has passed
+// through the cassette's BeforeReplayFilters, so the stored fixture
+// is never mutated by a filter.
 func (c *Cassette) GetInteraction(r *http.Request) (*Interaction, error) {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
 	for _, i := range c.Interactions {
+		if c.MatchMode == MatchModeSequential && i.consumed {
+			continue
+		}
 		if c.Matcher(r, i.Request) {
-			return i, nil
+			i.consumed = true
+			i.Count++
+
+			match := cloneInteraction(i)
+			for _, f := range c.BeforeReplayFilters {
+				if err := f(match); err != nil {
+					return nil, err
+				}
+			}
+			return match, nil
 		}
 	}
 
 	return nil, ErrInteractionNotFound
 }
 
-// Save writes the cassette data on disk for future re-use
+// Rewind resets every interaction's consumed state, so a cassette
+// in MatchModeSequential can be replayed again from its first
+// interaction. It does not reset Count.
+func (c *Cassette) Rewind() {
+	c.Lock()
+	defer c.Unlock()
+	for _, i := range c.Interactions {
+		i.consumed = false
+	}
+}
+
+// Remaining returns the interactions that have not yet been
+// consumed, i.e. the ones GetInteraction would still be able to
+// return under MatchModeSequential.
+func (c *Cassette) Remaining() []*Interaction {
+	c.RLock()
+	defer c.RUnlock()
+	remaining := make([]*Interaction, 0)
+	for _, i := range c.Interactions {
+		if !i.consumed {
+			remaining = append(remaining, i)
+		}
+	}
+	return remaining
+}
+
+// Load reads a cassette file from disk, auto-detecting its format
+// version. Cassettes recorded with format v1 are upgraded to v2 in
+// memory, so old fixtures keep working with no changes required. If
+// "<name>.json" does not exist but a gzip-compressed "<name>.json.gz"
+// does, the gzip-compressed file is loaded instead, so a cassette
+// saved with a ".json.gz" File round-trips through Load.
+func Load(name string) (*Cassette, error) {
+	c := New(name)
+	if _, err := os.Stat(c.File); os.IsNotExist(err) {
+		if _, gzErr := os.Stat(c.File + ".gz"); gzErr == nil {
+			c.File += ".gz"
+		}
+	}
+
+	version, interactions, err := loadInteractions(c.File)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Version = version
+	c.Interactions = interactions
+	return c, nil
+}
+
+// loadInteractions reads a cassette file from disk and parses it,
+// auto-detecting and upgrading format v1 fixtures the same way Load
+// does. It is factored out of Load so a file-watch reload can
+// re-parse a cassette file without constructing a whole new
+// Cassette.
+func loadInteractions(file string) (int, []*Interaction, error) {
+	data, err := readCassetteFile(file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Peek at the version before committing to a concrete shape
+	var peek struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return 0, nil, err
+	}
+
+	switch peek.Version {
+	case cassetteFormatV2:
+		var c Cassette
+		if err := json.Unmarshal(data, &c); err != nil {
+			return 0, nil, err
+		}
+		return c.Version, c.Interactions, nil
+	case 0, cassetteFormatV1:
+		// Absent or v1: decode using the legacy shape and upgrade
+		var v1 cassetteV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return 0, nil, err
+		}
+		var c Cassette
+		v1.upgrade(&c)
+		return c.Version, c.Interactions, nil
+	default:
+		return 0, nil, ErrUnsupportedFormatVersion
+	}
+}
+
+// readCassetteFile reads a cassette file from disk, transparently
+// gunzipping it when its name ends in ".json.gz"
+func readCassetteFile(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(file, ".json.gz") {
+		return data, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+// Save writes the cassette data on disk for future re-use. When
+// c.File ends in ".json.gz" the whole cassette is gzip-compressed
+// before being written.
 func (c *Cassette) Save() error {
 	c.RLock()
 	defer c.RUnlock()
@@ -174,6 +610,14 @@ func (c *Cassette) Save() error {
 		return nil
 	}
 
+	if c.Strict {
+		for _, i := range c.Interactions {
+			if i.Count == 0 {
+				return ErrUnusedInteraction
+			}
+		}
+	}
+
 	// Create directory for cassette if missing
 	cassetteDir := filepath.Dir(c.File)
 	if _, err := os.Stat(cassetteDir); os.IsNotExist(err) {
@@ -182,12 +626,45 @@ func (c *Cassette) Save() error {
 		}
 	}
 
-	// Marshal to YAML and save interactions
-	data, err := json.MarshalIndent(c, "", "  ")
+	// Run BeforeSaveFilters against a deep copy so the in-memory
+	// interactions used by the rest of the test are never mutated
+	// by a filter
+	filtered := &Cassette{Version: c.Version, Interactions: make([]*Interaction, len(c.Interactions))}
+	for idx, i := range c.Interactions {
+		copied := cloneInteraction(i)
+		for _, f := range c.BeforeSaveFilters {
+			if err := f(copied); err != nil {
+				return err
+			}
+		}
+		filtered.Interactions[idx] = copied
+	}
+
+	// Marshal to JSON and save interactions, downgrading to the
+	// legacy v1 shape if the cassette was explicitly pinned to it
+	var data []byte
+	var err error
+	if c.Version == cassetteFormatV1 {
+		data, err = json.MarshalIndent(filtered.downgrade(), "", "  ")
+	} else {
+		data, err = json.MarshalIndent(filtered, "", "  ")
+	}
 	if err != nil {
 		return err
 	}
 
+	if strings.HasSuffix(c.File, ".json.gz") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
 	f, err := os.Create(c.File)
 	if err != nil {
 		return err
@@ -0,0 +1,320 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func newPollRequest() *http.Request {
+	r, err := http.NewRequest("GET", "http://example.com/poll", nil)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func newPollInteraction(status string) *Interaction {
+	return &Interaction{
+		Request:  Request{Method: "GET", URL: "http://example.com/poll"},
+		Response: Response{Code: 200, Status: status},
+	}
+}
+
+func TestGetInteractionSequential(t *testing.T) {
+	c := New("sequential")
+	c.MatchMode = MatchModeSequential
+	c.AddInteraction(newPollInteraction("pending"))
+	c.AddInteraction(newPollInteraction("done"))
+
+	r := newPollRequest()
+
+	first, err := c.GetInteraction(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if first.Status != "pending" {
+		t.Fatalf("expected first interaction to be %q, got %q", "pending", first.Status)
+	}
+
+	second, err := c.GetInteraction(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if second.Status != "done" {
+		t.Fatalf("expected second interaction to be %q, got %q", "done", second.Status)
+	}
+
+	if _, err := c.GetInteraction(r); err != ErrInteractionNotFound {
+		t.Fatalf("expected ErrInteractionNotFound once exhausted, got %v", err)
+	}
+}
+
+func TestGetInteractionAnyModeReusesFirstMatch(t *testing.T) {
+	c := New("any")
+	c.AddInteraction(newPollInteraction("pending"))
+	c.AddInteraction(newPollInteraction("done"))
+
+	r := newPollRequest()
+
+	for i := 0; i < 2; i++ {
+		match, err := c.GetInteraction(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if match.Status != "pending" {
+			t.Fatalf("expected MatchModeAny to keep returning %q, got %q", "pending", match.Status)
+		}
+	}
+}
+
+func TestRewind(t *testing.T) {
+	c := New("rewind")
+	c.MatchMode = MatchModeSequential
+	c.AddInteraction(newPollInteraction("pending"))
+
+	r := newPollRequest()
+	if _, err := c.GetInteraction(r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(c.Remaining()) != 0 {
+		t.Fatalf("expected no remaining interactions after consuming the only one")
+	}
+
+	c.Rewind()
+	if len(c.Remaining()) != 1 {
+		t.Fatalf("expected Rewind to restore the consumed interaction")
+	}
+
+	if _, err := c.GetInteraction(r); err != nil {
+		t.Fatalf("unexpected error after rewind: %s", err)
+	}
+	if c.Interactions[0].Count != 2 {
+		t.Fatalf("expected Count to keep accumulating across rewinds, got %d", c.Interactions[0].Count)
+	}
+}
+
+func TestSaveStrictFailsOnUnusedInteraction(t *testing.T) {
+	c := New("strict")
+	c.Strict = true
+	c.File = t.TempDir() + "/strict.json"
+	c.AddInteraction(newPollInteraction("pending"))
+
+	if err := c.Save(); err != ErrUnusedInteraction {
+		t.Fatalf("expected ErrUnusedInteraction, got %v", err)
+	}
+
+	if _, err := c.GetInteraction(newPollRequest()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("expected Save to succeed once the interaction was used, got %v", err)
+	}
+}
+
+func TestGetInteractionFilterDoesNotMutateStoredHeaders(t *testing.T) {
+	c := New("replay-filter")
+	c.AddReplayFilter(HeaderRedactor("Authorization"))
+	c.AddInteraction(&Interaction{
+		Request: Request{
+			Method:  "GET",
+			URL:     "http://example.com/poll",
+			Headers: http.Header{"Authorization": []string{"Bearer abc123"}},
+		},
+		Response: Response{Code: 200},
+	})
+
+	match, err := c.GetInteraction(newPollRequest())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := match.Request.Headers.Get("Authorization"); got != redactedValue {
+		t.Fatalf("expected returned interaction to be redacted, got %q", got)
+	}
+
+	if got := c.Interactions[0].Request.Headers.Get("Authorization"); got != "Bearer abc123" {
+		t.Fatalf("expected stored interaction's header to be untouched, got %q", got)
+	}
+}
+
+func TestSaveFilterDoesNotMutateStoredHeaders(t *testing.T) {
+	name := t.TempDir() + "/save-filter"
+	c := New(name)
+	c.AddFilter(HeaderRedactor("Authorization"))
+	c.AddInteraction(&Interaction{
+		Request: Request{
+			Method:  "GET",
+			URL:     "http://example.com/poll",
+			Headers: http.Header{"Authorization": []string{"Bearer abc123"}},
+		},
+		Response: Response{Code: 200},
+	})
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := c.Interactions[0].Request.Headers.Get("Authorization"); got != "Bearer abc123" {
+		t.Fatalf("expected Save's filter pass not to mutate the in-memory interaction, got %q", got)
+	}
+
+	reloaded, err := Load(name)
+	if err != nil {
+		t.Fatalf("unexpected error reloading saved cassette: %s", err)
+	}
+	if got := reloaded.Interactions[0].Request.Headers.Get("Authorization"); got != redactedValue {
+		t.Fatalf("expected the persisted fixture to be redacted, got %q", got)
+	}
+}
+
+func TestSaveLoadBinaryBodyRoundTrip(t *testing.T) {
+	name := t.TempDir() + "/binary"
+	c := New(name)
+
+	binary := []byte{0x00, 0xff, 0xfe, 0x89, 'P', 'N', 'G', 0x0d, 0x0a}
+	c.AddInteraction(&Interaction{
+		Request:  Request{Method: "POST", URL: "http://example.com/upload"},
+		Response: Response{Code: 200, Body: binary, BodyEncoding: BodyEncodingBase64},
+	})
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	reloaded, err := Load(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got := reloaded.Interactions[0].Response.Body
+	if !bytes.Equal(got, binary) {
+		t.Fatalf("expected binary body to round-trip unchanged, got %v want %v", got, binary)
+	}
+}
+
+func TestSaveLoadGzipCassetteRoundTrip(t *testing.T) {
+	name := t.TempDir() + "/gzip-cassette"
+	c := New(name)
+	c.File = name + ".json.gz"
+	c.AddInteraction(newPollInteraction("pending"))
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := os.Stat(name + ".json.gz"); err != nil {
+		t.Fatalf("expected a gzip-compressed cassette file on disk: %s", err)
+	}
+	if _, err := os.Stat(name + ".json"); !os.IsNotExist(err) {
+		t.Fatalf("expected no uncompressed cassette file to exist")
+	}
+
+	reloaded, err := Load(name)
+	if err != nil {
+		t.Fatalf("unexpected error loading gzip cassette via Load(name): %s", err)
+	}
+	if len(reloaded.Interactions) != 1 || reloaded.Interactions[0].Status != "pending" {
+		t.Fatalf("expected the gzip cassette's interaction to round-trip, got %+v", reloaded.Interactions)
+	}
+}
+
+func TestLoadUpgradesV1Fixture(t *testing.T) {
+	name := t.TempDir() + "/legacy"
+
+	v1 := `{
+		"version": 1,
+		"interactions": [{
+			"request": {"body": "hello", "url": "http://example.com/v1", "method": "GET"},
+			"response": {"body": "world", "status": "200 OK", "code": 200}
+		}]
+	}`
+	if err := ioutil.WriteFile(name+".json", []byte(v1), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err := Load(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if c.Version != cassetteFormatV2 {
+		t.Fatalf("expected a v1 fixture to be upgraded to version %d in memory, got %d", cassetteFormatV2, c.Version)
+	}
+	i := c.Interactions[0]
+	if i.Request.BodyEncoding != BodyEncodingUTF8 || i.Response.BodyEncoding != BodyEncodingUTF8 {
+		t.Fatalf("expected upgraded bodies to be tagged %q, got request=%q response=%q",
+			BodyEncodingUTF8, i.Request.BodyEncoding, i.Response.BodyEncoding)
+	}
+	if string(i.Request.Body) != "hello" || string(i.Response.Body) != "world" {
+		t.Fatalf("expected upgraded bodies to keep their content, got request=%q response=%q",
+			i.Request.Body, i.Response.Body)
+	}
+}
+
+func TestSetFormatVersionV1ProducesStringBody(t *testing.T) {
+	name := t.TempDir() + "/pinned-v1"
+	c := New(name)
+	if err := c.SetFormatVersion(cassetteFormatV1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.AddInteraction(&Interaction{
+		Request:  Request{Method: "GET", URL: "http://example.com/v1", Body: []byte("hello")},
+		Response: Response{Code: 200, Body: []byte("world")},
+	})
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(name + ".json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var onDisk struct {
+		Version      int `json:"version"`
+		Interactions []struct {
+			Request struct {
+				Body string `json:"body"`
+			} `json:"request"`
+		} `json:"interactions"`
+	}
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if onDisk.Version != cassetteFormatV1 {
+		t.Fatalf("expected the saved file to be pinned to version %d, got %d", cassetteFormatV1, onDisk.Version)
+	}
+	if onDisk.Interactions[0].Request.Body != "hello" {
+		t.Fatalf("expected the v1 file to store the body as a plain string, got %q", onDisk.Interactions[0].Request.Body)
+	}
+}
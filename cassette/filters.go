@@ -0,0 +1,179 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redactedValue replaces any field a redacting filter matches
+const redactedValue = "REDACTED"
+
+// HeaderRedactor returns a Filter that overwrites the named headers
+// (case-insensitive) on both the request and the response with
+// redactedValue, so values such as bearer tokens or API keys never
+// reach disk.
+func HeaderRedactor(headers ...string) Filter {
+	canonical := make([]string, len(headers))
+	for i, h := range headers {
+		canonical[i] = http.CanonicalHeaderKey(h)
+	}
+
+	return func(i *Interaction) error {
+		for _, h := range canonical {
+			if _, ok := i.Request.Headers[h]; ok {
+				i.Request.Headers[h] = []string{redactedValue}
+			}
+			if _, ok := i.Response.Headers[h]; ok {
+				i.Response.Headers[h] = []string{redactedValue}
+			}
+		}
+		return nil
+	}
+}
+
+// QueryRedactor returns a Filter that overwrites the named query
+// string parameters on the recorded request URL with redactedValue.
+func QueryRedactor(params ...string) Filter {
+	return func(i *Interaction) error {
+		u, err := url.Parse(i.Request.URL)
+		if err != nil {
+			return err
+		}
+
+		q := u.Query()
+		changed := false
+		for _, p := range params {
+			if _, ok := q[p]; ok {
+				q.Set(p, redactedValue)
+				changed = true
+			}
+		}
+
+		if changed {
+			u.RawQuery = q.Encode()
+			i.Request.URL = u.String()
+		}
+		return nil
+	}
+}
+
+// JSONBodyRedactor returns a Filter that overwrites the values at
+// the given dotted JSON paths (e.g. "$.password" or
+// "$.credentials.secret") in both the request and response bodies
+// with redactedValue. Bodies that are not JSON objects are left
+// untouched. Bodies stored with BodyEncodingGzipBase64 are
+// decompressed before redaction and recompressed afterwards, so
+// compressed fixtures are redacted the same as plain ones.
+func JSONBodyRedactor(paths ...string) Filter {
+	return func(i *Interaction) error {
+		redacted, err := redactJSONBody(i.Request.Body, i.Request.BodyEncoding, paths)
+		if err != nil {
+			return err
+		}
+		if redacted != nil {
+			i.Request.Body = redacted
+		}
+
+		redacted, err = redactJSONBody(i.Response.Body, i.Response.BodyEncoding, paths)
+		if err != nil {
+			return err
+		}
+		if redacted != nil {
+			i.Response.Body = redacted
+		}
+
+		return nil
+	}
+}
+
+// redactJSONBody redacts the given dotted paths in a JSON-object
+// body stored under encoding, decompressing and recompressing it as
+// needed around the redaction. It returns (nil, nil) when the
+// decoded body does not hold a JSON object, so callers can tell
+// "nothing to do" from "redacted to this value".
+func redactJSONBody(body []byte, encoding string, paths []string) ([]byte, error) {
+	decoded, err := decodeBody(body, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, nil
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(decoded, &doc); err != nil {
+		return nil, nil
+	}
+
+	for _, p := range paths {
+		setJSONPath(doc, strings.TrimPrefix(p, "$."))
+	}
+
+	redacted, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeBody(redacted, encoding)
+}
+
+// setJSONPath overwrites the value at a dotted path (e.g.
+// "credentials.secret") inside doc with redactedValue. Missing paths
+// are silently ignored.
+func setJSONPath(doc map[string]interface{}, path string) {
+	keys := strings.Split(path, ".")
+	node := doc
+	for idx, key := range keys {
+		if idx == len(keys)-1 {
+			if _, ok := node[key]; ok {
+				node[key] = redactedValue
+			}
+			return
+		}
+
+		child, ok := node[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		node = child
+	}
+}
+
+// ComposeFilters returns a Filter that runs each of filters in
+// order, stopping at the first one that returns an error.
+func ComposeFilters(filters ...Filter) Filter {
+	return func(i *Interaction) error {
+		for _, f := range filters {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,166 @@
+package cassette
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestInteraction() *Interaction {
+	return &Interaction{
+		Request: Request{
+			URL:    "http://example.com/login?access_token=abc123",
+			Method: "POST",
+			Headers: http.Header{
+				"Authorization": []string{"Bearer abc123"},
+				"Content-Type":  []string{"application/json"},
+			},
+			Body:         []byte(`{"username":"bob","password":"hunter2"}`),
+			BodyEncoding: BodyEncodingUTF8,
+		},
+		Response: Response{
+			Code:         200,
+			Headers:      http.Header{"Set-Cookie": []string{"session=xyz"}},
+			Body:         []byte(`{"token":"xyz789"}`),
+			BodyEncoding: BodyEncodingUTF8,
+		},
+	}
+}
+
+func TestFilterOrdering(t *testing.T) {
+	var order []string
+	first := func(i *Interaction) error {
+		order = append(order, "first")
+		return nil
+	}
+	second := func(i *Interaction) error {
+		order = append(order, "second")
+		return nil
+	}
+
+	c := New("ordering")
+	c.AddFilter(first)
+	c.AddFilter(second)
+
+	i := newTestInteraction()
+	for _, f := range c.BeforeSaveFilters {
+		if err := f(i); err != nil {
+			t.Fatalf("unexpected filter error: %s", err)
+		}
+	}
+
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("expected filters to run in registration order, got %v", order)
+	}
+}
+
+func TestFilterErrorPropagation(t *testing.T) {
+	wantErr := errors.New("boom")
+	ran := false
+
+	c := New(t.TempDir() + "/errors")
+	c.AddFilter(func(i *Interaction) error { return wantErr })
+	c.AddFilter(func(i *Interaction) error {
+		ran = true
+		return nil
+	})
+	c.AddInteraction(newTestInteraction())
+
+	gotErr := c.Save()
+
+	if gotErr != wantErr {
+		t.Fatalf("expected error %q to propagate, got %v", wantErr, gotErr)
+	}
+	if ran {
+		t.Fatalf("expected filter chain to stop after the first error")
+	}
+}
+
+func TestHeaderRedactor(t *testing.T) {
+	f := HeaderRedactor("Authorization", "Set-Cookie")
+	i := newTestInteraction()
+
+	if err := f(i); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := i.Request.Headers.Get("Authorization"); got != redactedValue {
+		t.Errorf("expected Authorization to be redacted, got %q", got)
+	}
+	if got := i.Response.Headers.Get("Set-Cookie"); got != redactedValue {
+		t.Errorf("expected Set-Cookie to be redacted, got %q", got)
+	}
+	if got := i.Request.Headers.Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected unrelated header to be left alone, got %q", got)
+	}
+}
+
+func TestQueryRedactor(t *testing.T) {
+	f := QueryRedactor("access_token")
+	i := newTestInteraction()
+
+	if err := f(i); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := "http://example.com/login?access_token=REDACTED"
+	if i.Request.URL != want {
+		t.Errorf("expected URL %q, got %q", want, i.Request.URL)
+	}
+}
+
+func TestJSONBodyRedactor(t *testing.T) {
+	f := JSONBodyRedactor("$.password", "$.token")
+	i := newTestInteraction()
+
+	if err := f(i); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got := string(i.Request.Body); !strings.Contains(got, `"password":"REDACTED"`) {
+		t.Errorf("expected password to be redacted, got %s", got)
+	}
+	if got := string(i.Response.Body); !strings.Contains(got, `"token":"REDACTED"`) {
+		t.Errorf("expected token to be redacted, got %s", got)
+	}
+}
+
+func TestJSONBodyRedactorGzipEncodedBody(t *testing.T) {
+	i := newTestInteraction()
+	i.Request.BodyEncoding = BodyEncodingGzipBase64
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(i.Request.Body); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Request.Body = buf.Bytes()
+
+	f := JSONBodyRedactor("$.password")
+	if err := f(i); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	decoded, err := i.Request.DecodedBody()
+	if err != nil {
+		t.Fatalf("unexpected error decoding redacted body: %s", err)
+	}
+	if got := string(decoded); !strings.Contains(got, `"password":"REDACTED"`) {
+		t.Errorf("expected password to be redacted in a gzip-encoded body, got %s", got)
+	}
+}
+
+func TestCassetteAddFilterChaining(t *testing.T) {
+	c := New("chaining")
+	c.AddFilter(HeaderRedactor("Authorization")).AddFilter(QueryRedactor("access_token"))
+
+	if len(c.BeforeSaveFilters) != 2 {
+		t.Fatalf("expected AddFilter to chain, got %d filters", len(c.BeforeSaveFilters))
+	}
+}
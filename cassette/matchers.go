@@ -0,0 +1,270 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// errMissingBoundary indicates a multipart/form-data body's
+// Content-Type header did not carry a boundary parameter
+var errMissingBoundary = errors.New("cassette: multipart Content-Type has no boundary")
+
+// MethodURLMatcher is DefaultMatcher under a name that reads better
+// alongside the other matchers in this file: it matches on the
+// request method and URL only.
+var MethodURLMatcher = DefaultMatcher
+
+// readRequestBody reads r.Body in full and replaces it with a fresh
+// reader over the same bytes, so a matcher can inspect the body
+// without stopping the request from being sent afterwards.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+// JSONBodyMatcherOption configures a matcher returned by
+// JSONBodyMatcher.
+type JSONBodyMatcherOption func(*jsonBodyMatcherConfig)
+
+type jsonBodyMatcherConfig struct {
+	ignorePaths []string
+}
+
+// IgnorePaths returns a JSONBodyMatcherOption that excludes the
+// given dotted JSON paths (e.g. "$.request_id") from the comparison,
+// so volatile fields such as timestamps or generated IDs don't
+// prevent an otherwise identical body from matching.
+func IgnorePaths(paths ...string) JSONBodyMatcherOption {
+	return func(c *jsonBodyMatcherConfig) {
+		c.ignorePaths = append(c.ignorePaths, paths...)
+	}
+}
+
+// JSONBodyMatcher returns a Matcher that requires the method and URL
+// to match, then parses both bodies as JSON and compares them
+// structurally, so key order and whitespace differences are ignored.
+// Bodies that fail to parse as JSON never match.
+func JSONBodyMatcher(opts ...JSONBodyMatcherOption) Matcher {
+	cfg := &jsonBodyMatcherConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return func(r *http.Request, i Request) bool {
+		if !DefaultMatcher(r, i) {
+			return false
+		}
+
+		actualBody, err := readRequestBody(r)
+		if err != nil {
+			return false
+		}
+		recordedBody, err := i.DecodedBody()
+		if err != nil {
+			return false
+		}
+
+		var actual, recorded interface{}
+		if err := json.Unmarshal(actualBody, &actual); err != nil {
+			return false
+		}
+		if err := json.Unmarshal(recordedBody, &recorded); err != nil {
+			return false
+		}
+
+		for _, p := range cfg.ignorePaths {
+			path := strings.TrimPrefix(p, "$.")
+			deleteJSONPath(actual, path)
+			deleteJSONPath(recorded, path)
+		}
+
+		return reflect.DeepEqual(actual, recorded)
+	}
+}
+
+// deleteJSONPath removes the value at a dotted path (e.g.
+// "credentials.secret") from doc, if doc holds a JSON object and the
+// path exists. Anything else is left untouched.
+func deleteJSONPath(doc interface{}, path string) {
+	node, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	keys := strings.Split(path, ".")
+	for idx, key := range keys {
+		if idx == len(keys)-1 {
+			delete(node, key)
+			return
+		}
+
+		child, ok := node[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		node = child
+	}
+}
+
+// FormBodyMatcher is a Matcher that requires the method and URL to
+// match, then parses both bodies as application/x-www-form-urlencoded
+// and compares the resulting url.Values, so form fields may appear
+// in any order.
+func FormBodyMatcher(r *http.Request, i Request) bool {
+	if !DefaultMatcher(r, i) {
+		return false
+	}
+
+	actualBody, err := readRequestBody(r)
+	if err != nil {
+		return false
+	}
+	recordedBody, err := i.DecodedBody()
+	if err != nil {
+		return false
+	}
+
+	actual, err := url.ParseQuery(string(actualBody))
+	if err != nil {
+		return false
+	}
+	recorded, err := url.ParseQuery(string(recordedBody))
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(actual, recorded)
+}
+
+// MultipartMatcher is a Matcher that requires the method and URL to
+// match, then parses both bodies as multipart/form-data and compares
+// field names/values directly and file parts by the SHA-256 hash of
+// their contents, so differing boundary strings never cause a false
+// mismatch.
+func MultipartMatcher(r *http.Request, i Request) bool {
+	if !DefaultMatcher(r, i) {
+		return false
+	}
+
+	actualBody, err := readRequestBody(r)
+	if err != nil {
+		return false
+	}
+	recordedBody, err := i.DecodedBody()
+	if err != nil {
+		return false
+	}
+
+	actualFields, actualFiles, err := parseMultipart(actualBody, r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	recordedFields, recordedFiles, err := parseMultipart(recordedBody, i.Headers.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(actualFields, recordedFields) && reflect.DeepEqual(actualFiles, recordedFiles)
+}
+
+// parseMultipart reads a multipart/form-data body, returning its
+// plain form fields as url.Values and its file parts as a map of
+// field name to the hex-encoded SHA-256 hash of the file's contents.
+func parseMultipart(body []byte, contentType string) (url.Values, map[string]string, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, nil, errMissingBoundary
+	}
+
+	fields := url.Values{}
+	files := map[string]string{}
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FileName() == "" {
+			fields.Add(part.FormName(), string(data))
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		files[part.FormName()] = hex.EncodeToString(sum[:])
+	}
+
+	return fields, files, nil
+}
+
+// ComposeMatchers returns a Matcher that reports a match only when
+// every one of matchers agrees, short-circuiting at the first one
+// that doesn't.
+func ComposeMatchers(matchers ...Matcher) Matcher {
+	return func(r *http.Request, i Request) bool {
+		for _, m := range matchers {
+			if !m(r, i) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newJSONRequest(body string) *http.Request {
+	r, err := http.NewRequest("POST", "http://example.com/widgets", strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestJSONBodyMatcher(t *testing.T) {
+	m := JSONBodyMatcher()
+	i := Request{
+		Method:       "POST",
+		URL:          "http://example.com/widgets",
+		Body:         []byte(`{"name":"bob","tags":["a","b"]}`),
+		BodyEncoding: BodyEncodingUTF8,
+	}
+
+	r := newJSONRequest(`{  "tags": ["a", "b"], "name": "bob"  }`)
+	if !m(r, i) {
+		t.Fatalf("expected structurally equal JSON bodies to match")
+	}
+
+	r = newJSONRequest(`{"name":"alice","tags":["a","b"]}`)
+	if m(r, i) {
+		t.Fatalf("expected differing JSON bodies not to match")
+	}
+}
+
+func TestJSONBodyMatcherIgnorePaths(t *testing.T) {
+	m := JSONBodyMatcher(IgnorePaths("$.request_id"))
+	i := Request{
+		Method:       "POST",
+		URL:          "http://example.com/widgets",
+		Body:         []byte(`{"name":"bob","request_id":"rec-1"}`),
+		BodyEncoding: BodyEncodingUTF8,
+	}
+
+	r := newJSONRequest(`{"name":"bob","request_id":"live-2"}`)
+	if !m(r, i) {
+		t.Fatalf("expected bodies differing only in an ignored path to match")
+	}
+}
+
+func TestFormBodyMatcher(t *testing.T) {
+	i := Request{
+		Method:       "POST",
+		URL:          "http://example.com/widgets",
+		Body:         []byte("b=2&a=1"),
+		BodyEncoding: BodyEncodingUTF8,
+	}
+
+	r, err := http.NewRequest("POST", "http://example.com/widgets", strings.NewReader("a=1&b=2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !FormBodyMatcher(r, i) {
+		t.Fatalf("expected equivalent form bodies to match regardless of field order")
+	}
+}
+
+func TestMultipartMatcher(t *testing.T) {
+	build := func() (*bytes.Buffer, string) {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		if err := w.WriteField("name", "bob"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		fw, err := w.CreateFormFile("avatar", "avatar.png")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := fw.Write([]byte("fake-png-bytes")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return &buf, w.FormDataContentType()
+	}
+
+	recordedBuf, recordedContentType := build()
+	i := Request{
+		Method:       "POST",
+		URL:          "http://example.com/widgets",
+		Body:         recordedBuf.Bytes(),
+		BodyEncoding: BodyEncodingUTF8,
+		Headers:      http.Header{"Content-Type": []string{recordedContentType}},
+	}
+
+	actualBuf, actualContentType := build()
+	r, err := http.NewRequest("POST", "http://example.com/widgets", actualBuf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r.Header.Set("Content-Type", actualContentType)
+
+	if !MultipartMatcher(r, i) {
+		t.Fatalf("expected equivalent multipart bodies with different boundaries to match")
+	}
+}
+
+func TestComposeMatchers(t *testing.T) {
+	alwaysTrue := func(r *http.Request, i Request) bool { return true }
+	alwaysFalse := func(r *http.Request, i Request) bool { return false }
+
+	m := ComposeMatchers(alwaysTrue, alwaysFalse)
+	if m(nil, Request{}) {
+		t.Fatalf("expected ComposeMatchers to require every matcher to agree")
+	}
+
+	m = ComposeMatchers(MethodURLMatcher, alwaysTrue)
+	r, err := http.NewRequest("GET", "http://example.com/widgets", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !m(r, Request{Method: "GET", URL: "http://example.com/widgets"}) {
+		t.Fatalf("expected ComposeMatchers to match when every matcher agrees")
+	}
+}
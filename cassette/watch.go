@@ -0,0 +1,190 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadCallback is invoked after a watched cassette file is
+// re-read from disk, with the interactions that were replaced (old)
+// and the ones that replaced them (new).
+type reloadCallback func(old, new []*Interaction)
+
+// watch holds the file-watch state for a Cassette started with
+// LoadWithWatch.
+type watch struct {
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+
+	mu        sync.Mutex
+	callbacks []reloadCallback
+}
+
+// LoadWithWatch behaves like Load, but additionally starts an
+// fsnotify watch on the cassette file. Whenever the file is written
+// or recreated on disk, it is re-read and re-unmarshalled, and the
+// cassette's Interactions are atomically swapped in under c.Lock,
+// so a running test harness or mock server backed by the cassette
+// picks up hand-edited fixtures without a restart. The returned stop
+// function is equivalent to calling c.StopWatch and should be called
+// once the cassette is no longer needed.
+//
+// The watch is kept on the cassette file's parent directory rather
+// than the file itself, because many editors and tools save by
+// writing a temp file and renaming it over the original; fsnotify
+// stops delivering events for a file once it has been replaced this
+// way, but a directory watch keeps working since it is never itself
+// replaced. Events for files other than c.File are ignored.
+func LoadWithWatch(name string) (*Cassette, func() error, error) {
+	c, err := Load(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(c.File)); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+
+	w := &watch{
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+
+	c.Lock()
+	c.watch = w
+	c.Unlock()
+
+	go c.watchLoop(w)
+
+	return c, c.StopWatch, nil
+}
+
+// OnReload registers a callback that runs after every reload
+// triggered by a watch started with LoadWithWatch, with the
+// interactions that were replaced (old) and the ones that replaced
+// them (new). It is a no-op on a cassette that was not loaded with
+// LoadWithWatch.
+func (c *Cassette) OnReload(cb func(old, new []*Interaction)) {
+	c.RLock()
+	w := c.watch
+	c.RUnlock()
+
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.callbacks = append(w.callbacks, cb)
+	w.mu.Unlock()
+}
+
+// StopWatch stops the file watch started by LoadWithWatch and
+// closes its underlying fsnotify.Watcher. It is safe to call on a
+// cassette that was never watched, or more than once.
+func (c *Cassette) StopWatch() error {
+	c.Lock()
+	w := c.watch
+	c.watch = nil
+	c.Unlock()
+
+	if w == nil {
+		return nil
+	}
+
+	close(w.done)
+	return w.watcher.Close()
+}
+
+// watchLoop re-reads the cassette file on every WRITE or CREATE
+// event until the watch is stopped or its watcher's channels are
+// closed. Errors returned by fsnotify itself are ignored, since
+// there is nothing better to do with them here: the cassette simply
+// keeps serving its last-known-good Interactions.
+func (c *Cassette) watchLoop(w *watch) {
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			c.RLock()
+			file := c.File
+			c.RUnlock()
+			if filepath.Base(event.Name) != filepath.Base(file) {
+				continue
+			}
+			c.reload(w)
+		case _, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// reload re-reads the cassette file from disk and atomically swaps
+// in the freshly parsed Interactions, then runs every callback
+// registered with OnReload. A file that fails to parse (e.g. because
+// it was only partially written) is ignored, leaving the cassette's
+// current Interactions in place.
+func (c *Cassette) reload(w *watch) {
+	c.RLock()
+	file := c.File
+	c.RUnlock()
+
+	version, interactions, err := loadInteractions(file)
+	if err != nil {
+		return
+	}
+
+	c.Lock()
+	old := c.Interactions
+	c.Interactions = interactions
+	c.Version = version
+	c.Unlock()
+
+	w.mu.Lock()
+	callbacks := append([]reloadCallback(nil), w.callbacks...)
+	w.mu.Unlock()
+
+	for _, cb := range callbacks {
+		cb(old, interactions)
+	}
+}
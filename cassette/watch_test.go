@@ -0,0 +1,161 @@
+// Copyright (c) 2015 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer
+//    in this position and unchanged.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cassette
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCassette(t *testing.T, file string, urls ...string) {
+	t.Helper()
+
+	c := New("watch")
+	c.File = file
+	for _, u := range urls {
+		c.AddInteraction(&Interaction{
+			Request:  Request{Method: "GET", URL: u},
+			Response: Response{Code: 200},
+		})
+	}
+	if err := c.Save(); err != nil {
+		t.Fatalf("failed to write test cassette: %s", err)
+	}
+}
+
+func TestLoadWithWatchReloadsOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "watched")
+	writeTestCassette(t, name+".json", "http://example.com/v1")
+
+	c, stop, err := LoadWithWatch(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer stop()
+
+	reloaded := make(chan struct{}, 1)
+	c.OnReload(func(old, new []*Interaction) {
+		reloaded <- struct{}{}
+	})
+
+	writeTestCassette(t, name+".json", "http://example.com/v1", "http://example.com/v2")
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnReload callback")
+	}
+
+	c.RLock()
+	got := len(c.Interactions)
+	c.RUnlock()
+	if got != 2 {
+		t.Fatalf("expected 2 interactions after reload, got %d", got)
+	}
+}
+
+func TestLoadWithWatchReloadsOnAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "watched")
+	writeTestCassette(t, name+".json", "http://example.com/v1")
+
+	c, stop, err := LoadWithWatch(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer stop()
+
+	reloaded := make(chan struct{}, 1)
+	c.OnReload(func(old, new []*Interaction) {
+		reloaded <- struct{}{}
+	})
+
+	// Simulate the write-temp-then-rename-over pattern used by many
+	// editors: the replaced file keeps its old inode, which would
+	// silently stop delivering events on a file-level fsnotify watch.
+	tmp := name + ".json.tmp"
+	writeTestCassette(t, tmp, "http://example.com/v1", "http://example.com/v2")
+	if err := os.Rename(tmp, name+".json"); err != nil {
+		t.Fatalf("unexpected error renaming fixture into place: %s", err)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnReload callback")
+	}
+
+	c.RLock()
+	got := len(c.Interactions)
+	c.RUnlock()
+	if got != 2 {
+		t.Fatalf("expected 2 interactions after reload, got %d", got)
+	}
+}
+
+func TestStopWatchIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "watched")
+	writeTestCassette(t, name+".json", "http://example.com/v1")
+
+	c, stop, err := LoadWithWatch(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("unexpected error stopping watch: %s", err)
+	}
+	if err := c.StopWatch(); err != nil {
+		t.Fatalf("expected a second StopWatch call to be a no-op, got %s", err)
+	}
+}
+
+func TestOnReloadWithoutWatchIsNoop(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "unwatched")
+	writeTestCassette(t, name+".json", "http://example.com/v1")
+
+	c, err := Load(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.OnReload(func(old, new []*Interaction) {
+		t.Fatal("OnReload callback should never run on an unwatched cassette")
+	})
+
+	data, err := ioutil.ReadFile(name + ".json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(data) == 0 {
+		t.Fatalf("expected a non-empty fixture file")
+	}
+}